@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// ValidateTraitsResponse is the response body for /hooks/validate-traits:
+// the same violation messages webhookHandler reports, plus a Diff entry
+// per offending value showing what the caller attempted against what
+// remains allowed.
+type ValidateTraitsResponse struct {
+	Messages []WebhookResponseTopMessage `json:"messages"`
+	Diff     []TraitDiff                 `json:"diff,omitempty"`
+}
+
+// TraitDiff describes one trait value a request tried to change that its
+// schema forbids, addressed the same way as WebhookResponseTopMessage.
+type TraitDiff struct {
+	InstancePtr string      `json:"instance_ptr"`
+	Attempted   interface{} `json:"attempted"`
+	Allowed     interface{} `json:"allowed"`
+}
+
+// MutateTraitsResponse is the response body for /hooks/mutate-traits: an
+// RFC 6902 JSON Patch document a Kratos-compatible caller can apply to
+// the identity to silently revert every forbidden change back to its
+// OldTraits value.
+type MutateTraitsResponse = JSONPatch
+
+// JSONPatch is an RFC 6902 JSON Patch document: an ordered list of
+// operations a caller applies in sequence.
+type JSONPatch []JSONPatchOp
+
+// JSONPatchOp is a single RFC 6902 operation. Value is omitted for "remove".
+type JSONPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// traitDiffs renders changes as the attempted-vs-allowed diff reported by
+// /hooks/validate-traits.
+func traitDiffs(changes []traitChange) []TraitDiff {
+	diffs := make([]TraitDiff, 0, len(changes))
+	for _, c := range changes {
+		diffs = append(diffs, TraitDiff{
+			InstancePtr: "#" + c.pointer,
+			Attempted:   c.newVal,
+			Allowed:     c.oldVal,
+		})
+	}
+	return diffs
+}
+
+// buildRevertPatch renders changes as the JSON Patch that would revert
+// every one of them back to its OldTraits value: "replace" when the trait
+// had a prior value, "remove" when the trait didn't exist before.
+func buildRevertPatch(changes []traitChange) JSONPatch {
+	patch := make(JSONPatch, 0, len(changes))
+	for _, c := range changes {
+		if c.hadOld {
+			patch = append(patch, JSONPatchOp{Op: "replace", Path: c.pointer, Value: c.oldVal})
+		} else {
+			patch = append(patch, JSONPatchOp{Op: "remove", Path: c.pointer})
+		}
+	}
+	return patch
+}
+
+// isDryRun reports whether the request opted into dry-run mode via
+// ?dryRun=true. In dry-run mode a handler performs its full evaluation
+// but never signals rejection, so operators can test a schema change
+// against live traffic before enforcing it.
+func isDryRun(r *http.Request) bool {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+	return dryRun
+}
+
+// decodeWebhookRequest reads and JSON-decodes a webhook request body,
+// writing a 400 response and returning ok=false on failure.
+func decodeWebhookRequest(w http.ResponseWriter, r *http.Request) (WebhookRequest, bool) {
+	var payload WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return WebhookRequest{}, false
+	}
+	return payload, true
+}
+
+// forbiddenChangesForRequest fetches schemaID's immutability rules and
+// evaluates them against payload, writing a 500 response and returning
+// ok=false on failure.
+func forbiddenChangesForRequest(w http.ResponseWriter, r *http.Request, payload WebhookRequest) ([]traitChange, bool) {
+	rules, err := schemaCache.ImmutableRules(r.Context(), payload.SchemaID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to obtain schema immutable traits: %v", err), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	changes := collectForbiddenChanges(rules, payload.OldTraits, payload.NewTraits, payload.Identity, payload.Flow)
+	return changes, true
+}
+
+// validateTraitsHandler behaves like webhookHandler, but always responds
+// with a ValidateTraitsResponse describing exactly what was attempted
+// against what remains allowed, instead of a bare Kratos webhook
+// response. With ?dryRun=true it never returns 409, only marking the
+// response with X-Dry-Run so operators can test a schema change safely.
+func validateTraitsHandler(w http.ResponseWriter, r *http.Request) {
+	payload, ok := decodeWebhookRequest(w, r)
+	if !ok {
+		return
+	}
+
+	changes, ok := forbiddenChangesForRequest(w, r, payload)
+	if !ok {
+		return
+	}
+
+	response := ValidateTraitsResponse{
+		Messages: localizedViolationMessages(r, violationMessages(changes)),
+		Diff:     traitDiffs(changes),
+	}
+
+	dryRun := isDryRun(r)
+	if dryRun {
+		w.Header().Set("X-Dry-Run", "true")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(response.Messages) > 0 && !dryRun {
+		w.WriteHeader(http.StatusConflict)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// mutateTraitsHandler never rejects a request. Instead it responds with
+// an RFC 6902 JSON Patch document that reverts every forbidden change
+// back to its OldTraits value, for Kratos-compatible callers to apply
+// themselves; this module never mutates the identity directly. ?dryRun=true
+// still evaluates and returns the would-be patch, only adding the
+// X-Dry-Run marker, since this endpoint never signals rejection anyway.
+func mutateTraitsHandler(w http.ResponseWriter, r *http.Request) {
+	payload, ok := decodeWebhookRequest(w, r)
+	if !ok {
+		return
+	}
+
+	changes, ok := forbiddenChangesForRequest(w, r, payload)
+	if !ok {
+		return
+	}
+
+	patch := buildRevertPatch(changes)
+
+	if isDryRun(r) {
+		w.Header().Set("X-Dry-Run", "true")
+	}
+
+	w.Header().Set("Content-Type", "application/json-patch+json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(patch)
+}
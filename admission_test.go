@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestValidateTraitsHandler(t *testing.T) {
+	schemaBody := `{
+		"type": "object",
+		"properties": {
+			"traits": {
+				"properties": {
+					"email": { "readOnly": true },
+					"username": {}
+				}
+			}
+		}
+	}`
+
+	publicAPIServer := mockKratosPublicAPI("schema-validate", http.StatusOK, schemaBody)
+	defer publicAPIServer.Close()
+	os.Setenv("KRATOS_PUBLIC_URL", publicAPIServer.URL)
+
+	newRequest := func(query string) *http.Request {
+		webhookRequest := WebhookRequest{
+			SchemaID:  "schema-validate",
+			OldTraits: map[string]interface{}{"email": "old@example.com"},
+			NewTraits: map[string]interface{}{"email": "new@example.com"},
+		}
+		body, err := json.Marshal(webhookRequest)
+		if err != nil {
+			t.Fatalf("Failed to marshal request body: %v", err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/hooks/validate-traits"+query, nil)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return req
+	}
+
+	t.Run("forbidden change reports a 409 with the attempted vs allowed diff", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(validateTraitsHandler).ServeHTTP(rr, newRequest(""))
+
+		if rr.Code != http.StatusConflict {
+			t.Fatalf("expected status %d, got %d", http.StatusConflict, rr.Code)
+		}
+
+		var got ValidateTraitsResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if len(got.Diff) != 1 {
+			t.Fatalf("expected exactly 1 diff entry, got %d", len(got.Diff))
+		}
+		if got.Diff[0].InstancePtr != "#/traits/email" {
+			t.Errorf("expected diff instance_ptr %q, got %q", "#/traits/email", got.Diff[0].InstancePtr)
+		}
+		if got.Diff[0].Attempted != "new@example.com" || got.Diff[0].Allowed != "old@example.com" {
+			t.Errorf("unexpected diff values: %+v", got.Diff[0])
+		}
+		if len(got.Messages) != 1 || len(got.Messages[0].Messages) != 1 {
+			t.Fatalf("unexpected messages shape: %+v", got.Messages)
+		}
+		if got.Messages[0].Messages[0].Text != "Element is read-only." {
+			t.Errorf("expected validate-traits to report localized text like check-readonly-traits does, got %q", got.Messages[0].Messages[0].Text)
+		}
+	})
+
+	t.Run("Accept-Language negotiates the same bundled translation as check-readonly-traits", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := newRequest("")
+		req.Header.Set("Accept-Language", "it")
+		http.HandlerFunc(validateTraitsHandler).ServeHTTP(rr, req)
+
+		var got ValidateTraitsResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if got.Messages[0].Messages[0].Text != "L'elemento è di sola lettura." {
+			t.Errorf("expected Italian text, got %q", got.Messages[0].Messages[0].Text)
+		}
+	})
+
+	t.Run("dryRun=true never returns 409", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(validateTraitsHandler).ServeHTTP(rr, newRequest("?dryRun=true"))
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+		if rr.Header().Get("X-Dry-Run") != "true" {
+			t.Errorf("expected X-Dry-Run header to be set")
+		}
+
+		var got ValidateTraitsResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if len(got.Messages) != 1 {
+			t.Errorf("expected the would-be violation to still be reported, got %+v", got.Messages)
+		}
+	})
+}
+
+func TestMutateTraitsHandler(t *testing.T) {
+	schemaBody := `{
+		"type": "object",
+		"properties": {
+			"traits": {
+				"properties": {
+					"email": { "readOnly": true },
+					"username": {}
+				}
+			}
+		}
+	}`
+
+	publicAPIServer := mockKratosPublicAPI("schema-mutate", http.StatusOK, schemaBody)
+	defer publicAPIServer.Close()
+	os.Setenv("KRATOS_PUBLIC_URL", publicAPIServer.URL)
+
+	newRequest := func(newTraits map[string]interface{}, query string) *http.Request {
+		webhookRequest := WebhookRequest{
+			SchemaID: "schema-mutate",
+			OldTraits: map[string]interface{}{
+				"email": "old@example.com", "username": "alice",
+			},
+			NewTraits: newTraits,
+		}
+		body, err := json.Marshal(webhookRequest)
+		if err != nil {
+			t.Fatalf("Failed to marshal request body: %v", err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/hooks/mutate-traits"+query, nil)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return req
+	}
+
+	t.Run("reverts a forbidden change via a replace patch op", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := newRequest(map[string]interface{}{"email": "new@example.com", "username": "bob"}, "")
+		http.HandlerFunc(mutateTraitsHandler).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != "application/json-patch+json" {
+			t.Errorf("expected application/json-patch+json content type, got %q", ct)
+		}
+
+		var patch JSONPatch
+		if err := json.Unmarshal(rr.Body.Bytes(), &patch); err != nil {
+			t.Fatalf("failed to decode patch: %v", err)
+		}
+		if len(patch) != 1 {
+			t.Fatalf("expected exactly 1 patch op, got %d: %+v", len(patch), patch)
+		}
+		if patch[0].Op != "replace" || patch[0].Path != "/traits/email" || patch[0].Value != "old@example.com" {
+			t.Errorf("unexpected patch op: %+v", patch[0])
+		}
+	})
+
+	t.Run("dryRun=true still returns the would-be patch, marked with X-Dry-Run", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := newRequest(map[string]interface{}{"email": "new@example.com"}, "?dryRun=true")
+		http.HandlerFunc(mutateTraitsHandler).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+		if rr.Header().Get("X-Dry-Run") != "true" {
+			t.Errorf("expected X-Dry-Run header to be set")
+		}
+
+		var patch JSONPatch
+		if err := json.Unmarshal(rr.Body.Bytes(), &patch); err != nil {
+			t.Fatalf("failed to decode patch: %v", err)
+		}
+		if len(patch) != 1 {
+			t.Fatalf("expected exactly 1 patch op, got %d", len(patch))
+		}
+	})
+}
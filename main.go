@@ -1,19 +1,41 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// tracer emits spans for webhook evaluation. It is a no-op until the
+// embedding application registers a global TracerProvider.
+var tracer = otel.Tracer("github.com/zolfariot/kratos-readonly-traits")
+
 // Identity structure matching Kratos API response
 type Identity struct {
-	ID        string `json:"id"`
-	SchemaID  string `json:"schema_id"`	
-	Traits 	  map[string]interface{} `json:"traits"`
+	ID             string                 `json:"id"`
+	SchemaID       string                 `json:"schema_id"`
+	Traits         map[string]interface{} `json:"traits"`
+	MetadataPublic map[string]interface{} `json:"metadata_public"`
+	MetadataAdmin  map[string]interface{} `json:"metadata_admin"`
+}
+
+// Flow identifies the Kratos self-service flow (e.g. settings, recovery)
+// that triggered the webhook, matching the `flow` object Kratos includes
+// in its webhook payload template.
+type Flow struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
 }
 
 // Webhook request body
@@ -21,6 +43,8 @@ type WebhookRequest struct {
 	SchemaID  string         `json:"schema_id"`
 	OldTraits map[string]any `json:"old_traits"`
 	NewTraits map[string]any `json:"new_traits"`
+	Identity  *Identity      `json:"identity,omitempty"`
+	Flow      *Flow          `json:"flow,omitempty"`
 }
 
 type WebhookResponse struct {
@@ -36,50 +60,161 @@ type WebhookResponseNestedMessage struct {
 	ID   int    `json:"id"`
 	Text string `json:"text"`
 	Type string `json:"type"`
+	// Reason explains which rule blocked the change when it was a
+	// conditional one (see RulePredicate.Reason), e.g. the `when`
+	// expression or `unless_flow` exemption that matched. Empty for an
+	// unconditional readOnly/x-kratos-immutable-after-set rule.
+	Reason string `json:"reason,omitempty"`
+}
+
+// fetchSchemaImmutableRules fetches the identity schema for schemaID from
+// Kratos and returns the immutability rules derived from it. See
+// parseImmutableRules for how the schema is walked.
+func fetchSchemaImmutableRules(ctx context.Context, schemaID string) ([]ImmutableRule, error) {
+	result, err := fetchSchema(ctx, schemaID, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return parseImmutableRules(result.schema)
 }
 
-// KratosSchema represents the Kratos schema (simplified for this example)
-type KratosSchema struct {
-	Type       string `json:"type"`
-	Properties struct {
-		Traits struct {
-			Properties map[string]map[string]interface{}
-		} `json:"traits"`
-	} `json:"properties"`
+// schemaFetchResult is the outcome of a (possibly conditional) schema
+// fetch: either the raw schema body plus the validators needed to
+// revalidate it later, or notModified when Kratos returned 304 for the
+// validators we sent.
+type schemaFetchResult struct {
+	schema       []byte
+	etag         string
+	lastModified string
+	notModified  bool
 }
 
-// FetchSchema fetches the schema for identity traits from Kratos Admin API
-func fetchSchemaImmutableTraits(schemaID string) (map[string]struct{}, error) {
+// fetchSchema performs a GET against the Kratos public API for schemaID.
+// When etag or lastModified are non-empty they are sent as
+// If-None-Match / If-Modified-Since; a 304 response is reported via
+// result.notModified rather than as an error.
+func fetchSchema(ctx context.Context, schemaID, etag, lastModified string) (*schemaFetchResult, error) {
+	ctx, span := tracer.Start(ctx, "schema.fetch")
+	defer span.End()
+
 	kratosURL := os.Getenv("KRATOS_PUBLIC_URL")
 	if kratosURL == "" {
-		return nil, errors.New("Kratos URL is not set")
+		err := errors.New("Kratos URL is not set")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
 	}
 
 	log.Printf("Fetching schema (%s/schemas/%s)", kratosURL, schemaID)
 	// Fetch identity schema from Kratos
 	log.Printf("Sending request to %s/schemas/%s", kratosURL, schemaID)
-	resp, err := http.Get(fmt.Sprintf("%s/schemas/%s", kratosURL, schemaID))
-	if err != nil || resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to fetch schema: %v", err)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/schemas/%s", kratosURL, schemaID), nil)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, fmt.Errorf("failed to build schema request: %v", err)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		err = fmt.Errorf("failed to fetch schema: %v", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	var schema KratosSchema
-	err = json.NewDecoder(resp.Body).Decode(&schema)
+	if resp.StatusCode == http.StatusNotModified {
+		log.Printf("Schema not modified (%s/schemas/%s)", kratosURL, schemaID)
+		return &schemaFetchResult{notModified: true, etag: etag, lastModified: lastModified}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("failed to fetch schema: unexpected status %d", resp.StatusCode)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode schema: %v", err)
+		err = fmt.Errorf("failed to read schema: %v", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
 	}
 
-	// Process the schema to identify immutable traits
-	immutableTraits := make(map[string]struct{})
-	for trait, props := range schema.Properties.Traits.Properties {
-		if immutable, ok := props["zolfa.dev/kratos-readonly"]; ok && immutable.(bool) {
-			immutableTraits[trait] = struct{}{}
+	log.Printf("Schema fetched")
+	return &schemaFetchResult{
+		schema:       body,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// asyncDefault reports whether webhook requests should be handled in
+// "ignore response" mode (see Ory Kratos' response.ignore=true webhook
+// semantics) when the request does not explicitly opt in/out via the
+// ?async= query param.
+func asyncDefault() bool {
+	async, _ := strconv.ParseBool(os.Getenv("WEBHOOK_ASYNC"))
+	return async
+}
+
+// isAsyncRequest determines whether r should be handled asynchronously:
+// the ?async= query param always wins, falling back to asyncDefault().
+func isAsyncRequest(r *http.Request) bool {
+	if raw := r.URL.Query().Get("async"); raw != "" {
+		async, err := strconv.ParseBool(raw)
+		if err == nil {
+			return async
 		}
 	}
+	return asyncDefault()
+}
 
-	log.Printf("Schema fetched")
-	return immutableTraits, nil
+// evaluateReadonlyTraits fetches the identity schema and compares
+// old/new traits against it, returning the Kratos-compatible webhook
+// response describing any read-only violations.
+func evaluateReadonlyTraits(ctx context.Context, r *http.Request, payload WebhookRequest) (WebhookResponse, error) {
+	ctx, span := tracer.Start(ctx, "webhook.check_readonly_traits")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("webhook.http.method", r.Method),
+		attribute.String("webhook.http.url", r.URL.String()),
+		attribute.String("webhook.schema_id", payload.SchemaID),
+	)
+
+	rules, err := schemaCache.ImmutableRules(ctx, payload.SchemaID)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return WebhookResponse{}, err
+	}
+
+	_, compareSpan := tracer.Start(ctx, "traits.compare")
+	defer compareSpan.End()
+
+	messages, err := evaluateImmutableRules(rules, payload.OldTraits, payload.NewTraits, payload.Identity, payload.Flow)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		compareSpan.RecordError(err)
+		compareSpan.SetStatus(codes.Error, err.Error())
+		return WebhookResponse{}, err
+	}
+	response := WebhookResponse{Messages: messages}
+
+	violationCount := len(response.Messages)
+	span.SetAttributes(attribute.Int("webhook.violation_count", violationCount))
+	compareSpan.SetAttributes(attribute.Int("webhook.violation_count", violationCount))
+
+	return response, nil
 }
 
 // webhookHandler processes the webhook request
@@ -93,49 +228,50 @@ func webhookHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	immutableTraits, err := fetchSchemaImmutableTraits(payload.SchemaID)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to obtain schema immutable traits: %v", err), http.StatusInternalServerError)
-		return
-	}
+	if isAsyncRequest(r) {
+		// Detach from the inbound request's context so that Kratos
+		// closing the connection after we respond doesn't cancel the
+		// schema fetch and trait comparison still running in the
+		// background. The originating trace is preserved via a span
+		// link so the async work remains correlatable.
+		bg := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(r.Context()))
+		go func() {
+			response, err := evaluateReadonlyTraits(bg, r, payload)
+			if err != nil {
+				log.Printf("Async webhook evaluation failed: %v", err)
+				return
+			}
+			if len(response.Messages) > 0 {
+				log.Printf("Async update request would have been denied: %+v", response.Messages)
+			}
+		}()
 
-	response := WebhookResponse{
-		Messages: make([]WebhookResponseTopMessage, 0, len(immutableTraits)),
+		w.WriteHeader(http.StatusOK)
+		return
 	}
-	// Check for immutable traits and deny modification if changed
-	for trait := range immutableTraits {
-		if payload.NewTraits[trait] != nil && payload.NewTraits[trait] != payload.OldTraits[trait] {
-			response.Messages = append(response.Messages, WebhookResponseTopMessage{
-				InstancePtr: "#/traits/" + trait,
-				Messages: []WebhookResponseNestedMessage{
-					{
-						ID: 1377,
-						Text: "Element is read-only.",
-						Type: "conflict",
 
-					},
-				},
-			})
-		}
+	response, err := evaluateReadonlyTraits(r.Context(), r, payload)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to obtain schema immutable traits: %v", err), http.StatusInternalServerError)
+		return
 	}
 
-	if len(response.Messages) > 0 {
-		log.Printf("Update request denied")
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusConflict)
-		json.NewEncoder(w).Encode(response)
-	}
-	w.WriteHeader(http.StatusOK)
+	var reporter ViolationReporter
+	reporter.Report(w, r, response.Messages)
 }
 
 
 func main() {
 	port := os.Getenv("PORT")
-	if port == "" {	
+	if port == "" {
 		port = "3000" // Default port
 	}
 
+	schemaCache.StartBackgroundRefresh(context.Background())
+
 	http.HandleFunc("/hooks/check-readonly-traits", webhookHandler)
+	http.HandleFunc("/hooks/validate-traits", validateTraitsHandler)
+	http.HandleFunc("/hooks/mutate-traits", mutateTraitsHandler)
 
 	log.Println("Webhook running on port", port)
 	log.Fatal(http.ListenAndServe(":"+port, nil))
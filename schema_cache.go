@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// defaultSchemaCacheTTL is used when SCHEMA_CACHE_TTL is unset or invalid.
+const defaultSchemaCacheTTL = 60 * time.Second
+
+// schemaCache is the process-wide SchemaCache used by webhookHandler.
+var schemaCache = NewSchemaCache(schemaCacheTTLFromEnv())
+
+// cachedSchema holds the computed immutability rules for a schema
+// alongside the HTTP validators needed to revalidate it cheaply.
+type cachedSchema struct {
+	schemaID     string
+	rules        []ImmutableRule
+	etag         string
+	lastModified string
+	fetchedAt    time.Time
+}
+
+// SchemaCache caches the immutability rules computed from a Kratos
+// identity schema, keyed by KRATOS_PUBLIC_URL + schema ID. Once an
+// entry's TTL expires it is revalidated against Kratos using
+// ETag/Last-Modified conditional GETs rather than refetched outright,
+// and concurrent lookups for the same schema are deduplicated so only
+// one upstream request is ever in flight at a time.
+type SchemaCache struct {
+	ttl   time.Duration
+	mu    sync.RWMutex
+	cache map[string]*cachedSchema
+	group singleflight.Group
+}
+
+// NewSchemaCache creates a SchemaCache with the given TTL. A TTL of zero
+// disables caching: every lookup revalidates against Kratos.
+func NewSchemaCache(ttl time.Duration) *SchemaCache {
+	return &SchemaCache{
+		ttl:   ttl,
+		cache: make(map[string]*cachedSchema),
+	}
+}
+
+// schemaCacheTTLFromEnv reads SCHEMA_CACHE_TTL (a Go duration string,
+// e.g. "30s") and falls back to defaultSchemaCacheTTL when it is unset
+// or fails to parse.
+func schemaCacheTTLFromEnv() time.Duration {
+	raw := os.Getenv("SCHEMA_CACHE_TTL")
+	if raw == "" {
+		return defaultSchemaCacheTTL
+	}
+	ttl, err := time.ParseDuration(raw)
+	if err != nil {
+		log.Printf("Invalid SCHEMA_CACHE_TTL %q, using default %s: %v", raw, defaultSchemaCacheTTL, err)
+		return defaultSchemaCacheTTL
+	}
+	return ttl
+}
+
+// cacheKey returns the cache key for schemaID: KRATOS_PUBLIC_URL is part
+// of the key so a webhook pointed at a different Kratos instance never
+// serves stale traits from another.
+func (c *SchemaCache) cacheKey(schemaID string) string {
+	return os.Getenv("KRATOS_PUBLIC_URL") + schemaID
+}
+
+// ImmutableRules returns the immutability rules for schemaID, serving
+// them from cache when the entry is still within its TTL and
+// revalidating against Kratos otherwise.
+func (c *SchemaCache) ImmutableRules(ctx context.Context, schemaID string) ([]ImmutableRule, error) {
+	key := c.cacheKey(schemaID)
+
+	c.mu.RLock()
+	entry, ok := c.cache[key]
+	c.mu.RUnlock()
+	if ok && c.ttl > 0 && time.Since(entry.fetchedAt) < c.ttl {
+		return entry.rules, nil
+	}
+
+	v, err, _ := c.group.Do(key, func() (interface{}, error) {
+		return c.revalidate(ctx, schemaID, key, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]ImmutableRule), nil
+}
+
+// revalidate fetches schemaID from Kratos, sending the previous entry's
+// validators (if any), and updates the cache with the result.
+func (c *SchemaCache) revalidate(ctx context.Context, schemaID, key string, entry *cachedSchema) ([]ImmutableRule, error) {
+	var etag, lastModified string
+	if entry != nil {
+		etag, lastModified = entry.etag, entry.lastModified
+	}
+
+	result, err := fetchSchema(ctx, schemaID, etag, lastModified)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.notModified && entry != nil {
+		refreshed := &cachedSchema{
+			schemaID:     entry.schemaID,
+			rules:        entry.rules,
+			etag:         entry.etag,
+			lastModified: entry.lastModified,
+			fetchedAt:    time.Now(),
+		}
+		c.mu.Lock()
+		c.cache[key] = refreshed
+		c.mu.Unlock()
+		return refreshed.rules, nil
+	}
+
+	rules, err := parseImmutableRules(result.schema)
+	if err != nil {
+		return nil, err
+	}
+
+	fresh := &cachedSchema{
+		schemaID:     schemaID,
+		rules:        rules,
+		etag:         result.etag,
+		lastModified: result.lastModified,
+		fetchedAt:    time.Now(),
+	}
+	c.mu.Lock()
+	c.cache[key] = fresh
+	c.mu.Unlock()
+	return fresh.rules, nil
+}
+
+// StartBackgroundRefresh launches a goroutine that proactively
+// revalidates every cached schema once per TTL, so steady-state webhook
+// requests arriving right after an entry expires still get served from
+// cache instead of blocking on a synchronous Kratos round-trip. It runs
+// until ctx is canceled. A non-positive TTL disables background refresh
+// since caching itself is disabled.
+func (c *SchemaCache) StartBackgroundRefresh(ctx context.Context) {
+	if c.ttl <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(c.ttl)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.refreshAll(ctx)
+			}
+		}
+	}()
+}
+
+// refreshAll revalidates every schema currently in the cache.
+func (c *SchemaCache) refreshAll(ctx context.Context) {
+	c.mu.RLock()
+	keys := make(map[string]string, len(c.cache))
+	for key, entry := range c.cache {
+		keys[key] = entry.schemaID
+	}
+	c.mu.RUnlock()
+
+	for key, schemaID := range keys {
+		if _, err := c.ImmutableRules(ctx, schemaID); err != nil {
+			log.Printf("Background schema refresh failed for %q: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mockKratosSchemaServer serves a fixed schema body, tracking how many
+// times it was hit and honoring If-None-Match with a 304.
+func mockKratosSchemaServer(schemaID, etag, body string) (*httptest.Server, *int32) {
+	var hits int32
+	handler := http.NewServeMux()
+	handler.HandleFunc("/schemas/"+schemaID, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(body))
+	})
+	return httptest.NewServer(handler), &hits
+}
+
+func TestSchemaCacheImmutableRules(t *testing.T) {
+	schemaBody := `{
+		"type": "object",
+		"properties": {
+			"traits": {
+				"properties": {
+					"email": {
+						"zolfa.dev/kratos-readonly": true
+					}
+				}
+			}
+		}
+	}`
+
+	t.Run("serves repeated lookups from cache within TTL", func(t *testing.T) {
+		server, hits := mockKratosSchemaServer("schema1", "v1", schemaBody)
+		defer server.Close()
+		os.Setenv("KRATOS_PUBLIC_URL", server.URL)
+
+		cache := NewSchemaCache(time.Minute)
+		for i := 0; i < 3; i++ {
+			rules, err := cache.ImmutableRules(context.Background(), "schema1")
+			if err != nil {
+				t.Fatalf("ImmutableRules() error = %v", err)
+			}
+			if len(rules) != 1 {
+				t.Errorf("expected 1 immutability rule, got %v", rules)
+			}
+		}
+
+		if got := atomic.LoadInt32(hits); got != 1 {
+			t.Errorf("expected 1 upstream request, got %d", got)
+		}
+	})
+
+	t.Run("revalidates with conditional GET after TTL expiry", func(t *testing.T) {
+		server, hits := mockKratosSchemaServer("schema2", "v1", schemaBody)
+		defer server.Close()
+		os.Setenv("KRATOS_PUBLIC_URL", server.URL)
+
+		cache := NewSchemaCache(time.Millisecond)
+		if _, err := cache.ImmutableRules(context.Background(), "schema2"); err != nil {
+			t.Fatalf("ImmutableRules() error = %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+		if _, err := cache.ImmutableRules(context.Background(), "schema2"); err != nil {
+			t.Fatalf("ImmutableRules() error = %v", err)
+		}
+
+		if got := atomic.LoadInt32(hits); got != 2 {
+			t.Errorf("expected 2 upstream requests (initial fetch + revalidation), got %d", got)
+		}
+	})
+
+	t.Run("deduplicates concurrent lookups for the same schema", func(t *testing.T) {
+		server, hits := mockKratosSchemaServer("schema3", "v1", schemaBody)
+		defer server.Close()
+		os.Setenv("KRATOS_PUBLIC_URL", server.URL)
+
+		cache := NewSchemaCache(time.Minute)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := cache.ImmutableRules(context.Background(), "schema3"); err != nil {
+					t.Errorf("ImmutableRules() error = %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if got := atomic.LoadInt32(hits); got != 1 {
+			t.Errorf("expected concurrent lookups to collapse into 1 upstream request, got %d", got)
+		}
+	})
+
+	t.Run("keys entries by Kratos URL as well as schema ID", func(t *testing.T) {
+		serverA, hitsA := mockKratosSchemaServer("schema4", "v1", schemaBody)
+		defer serverA.Close()
+		serverB, hitsB := mockKratosSchemaServer("schema4", "v1", fmt.Sprintf(`{"type":"object","properties":{"traits":{"properties":{}}}}`))
+		defer serverB.Close()
+
+		cache := NewSchemaCache(time.Minute)
+
+		os.Setenv("KRATOS_PUBLIC_URL", serverA.URL)
+		if _, err := cache.ImmutableRules(context.Background(), "schema4"); err != nil {
+			t.Fatalf("ImmutableRules() error = %v", err)
+		}
+
+		os.Setenv("KRATOS_PUBLIC_URL", serverB.URL)
+		traits, err := cache.ImmutableRules(context.Background(), "schema4")
+		if err != nil {
+			t.Fatalf("ImmutableRules() error = %v", err)
+		}
+		if len(traits) != 0 {
+			t.Errorf("expected no immutable traits from serverB's schema, got %v", traits)
+		}
+
+		if got := atomic.LoadInt32(hitsA); got != 1 {
+			t.Errorf("expected 1 request to serverA, got %d", got)
+		}
+		if got := atomic.LoadInt32(hitsB); got != 1 {
+			t.Errorf("expected 1 request to serverB, got %d", got)
+		}
+	})
+}
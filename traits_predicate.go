@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/expr-lang/expr"
+)
+
+// RulePredicate gates whether an ImmutableRule applies to a given
+// webhook request, letting schema authors declare traits that are
+// immutable only under certain conditions, e.g.
+//
+//	"zolfa.dev/kratos-readonly": {"when": "identity.metadata_public.role != 'admin'"}
+//	"zolfa.dev/kratos-readonly": {"unless_flow": "recovery"}
+//
+// Both fields are optional; when both are set, the rule only applies
+// when neither exempts it (they are combined with AND).
+type RulePredicate struct {
+	// When is an expr-lang boolean expression evaluated against the
+	// request's identity and flow. Empty means "always true".
+	When string
+	// UnlessFlow exempts the rule when the triggering flow's type
+	// matches exactly. Empty means "no exemption".
+	UnlessFlow string
+}
+
+// parseRulePredicate reads the "when"/"unless_flow" keys out of a
+// zolfa.dev/kratos-readonly object annotation.
+func parseRulePredicate(raw map[string]interface{}) *RulePredicate {
+	pred := &RulePredicate{}
+	if when, ok := raw["when"].(string); ok {
+		pred.When = when
+	}
+	if unlessFlow, ok := raw["unless_flow"].(string); ok {
+		pred.UnlessFlow = unlessFlow
+	}
+	return pred
+}
+
+// evaluatePredicate reports whether pred applies to this request. A nil
+// predicate always applies.
+func evaluatePredicate(pred *RulePredicate, identity *Identity, flow *Flow) (bool, error) {
+	if pred == nil {
+		return true, nil
+	}
+
+	if pred.UnlessFlow != "" && flow != nil && flow.Type == pred.UnlessFlow {
+		return false, nil
+	}
+
+	if pred.When == "" {
+		return true, nil
+	}
+
+	env := predicateEnv(identity, flow)
+	program, err := expr.Compile(pred.When, expr.Env(env), expr.AsBool())
+	if err != nil {
+		return false, fmt.Errorf("compiling predicate %q: %v", pred.When, err)
+	}
+	out, err := expr.Run(program, env)
+	if err != nil {
+		return false, fmt.Errorf("evaluating predicate %q: %v", pred.When, err)
+	}
+	active, ok := out.(bool)
+	if !ok {
+		return false, fmt.Errorf("predicate %q did not evaluate to a boolean", pred.When)
+	}
+	return active, nil
+}
+
+// Reason describes why a matched predicate blocked a change, e.g. for
+// inclusion in a violation message alongside the generic read-only text.
+// It returns "" for a nil predicate, since an unconditional rule needs no
+// further explanation.
+func (pred *RulePredicate) Reason() string {
+	if pred == nil {
+		return ""
+	}
+	switch {
+	case pred.When != "" && pred.UnlessFlow != "":
+		return fmt.Sprintf("blocked because %s (unless the flow is %q)", pred.When, pred.UnlessFlow)
+	case pred.When != "":
+		return fmt.Sprintf("blocked because %s", pred.When)
+	case pred.UnlessFlow != "":
+		return fmt.Sprintf("blocked outside the %q flow", pred.UnlessFlow)
+	default:
+		return ""
+	}
+}
+
+// predicateEnv builds the expr-lang evaluation environment exposed to
+// rule predicates: `identity.*` and `flow.*`, matching the shape of
+// Kratos' webhook payload template.
+func predicateEnv(identity *Identity, flow *Flow) map[string]interface{} {
+	identityEnv := map[string]interface{}{}
+	if identity != nil {
+		identityEnv["id"] = identity.ID
+		identityEnv["schema_id"] = identity.SchemaID
+		identityEnv["traits"] = identity.Traits
+		identityEnv["metadata_public"] = identity.MetadataPublic
+		identityEnv["metadata_admin"] = identity.MetadataAdmin
+	}
+
+	flowEnv := map[string]interface{}{}
+	if flow != nil {
+		flowEnv["id"] = flow.ID
+		flowEnv["type"] = flow.Type
+	}
+
+	return map[string]interface{}{
+		"identity": identityEnv,
+		"flow":     flowEnv,
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import "testing"
+
+func TestEvaluatePredicate(t *testing.T) {
+	t.Run("nil predicate always applies", func(t *testing.T) {
+		active, err := evaluatePredicate(nil, nil, nil)
+		if err != nil {
+			t.Fatalf("evaluatePredicate() error = %v", err)
+		}
+		if !active {
+			t.Errorf("expected nil predicate to always apply")
+		}
+	})
+
+	t.Run("when expression reads identity metadata", func(t *testing.T) {
+		pred := &RulePredicate{When: "identity.metadata_public.role != 'admin'"}
+
+		admin := &Identity{MetadataPublic: map[string]interface{}{"role": "admin"}}
+		active, err := evaluatePredicate(pred, admin, nil)
+		if err != nil {
+			t.Fatalf("evaluatePredicate() error = %v", err)
+		}
+		if active {
+			t.Errorf("expected rule to be inactive for an admin")
+		}
+
+		user := &Identity{MetadataPublic: map[string]interface{}{"role": "user"}}
+		active, err = evaluatePredicate(pred, user, nil)
+		if err != nil {
+			t.Fatalf("evaluatePredicate() error = %v", err)
+		}
+		if !active {
+			t.Errorf("expected rule to be active for a non-admin")
+		}
+	})
+
+	t.Run("unless_flow exempts the named flow", func(t *testing.T) {
+		pred := &RulePredicate{UnlessFlow: "recovery"}
+
+		active, err := evaluatePredicate(pred, nil, &Flow{Type: "recovery"})
+		if err != nil {
+			t.Fatalf("evaluatePredicate() error = %v", err)
+		}
+		if active {
+			t.Errorf("expected recovery flow to be exempted")
+		}
+
+		active, err = evaluatePredicate(pred, nil, &Flow{Type: "settings"})
+		if err != nil {
+			t.Fatalf("evaluatePredicate() error = %v", err)
+		}
+		if !active {
+			t.Errorf("expected non-recovery flow to keep the rule active")
+		}
+	})
+
+	t.Run("invalid expression surfaces as an error", func(t *testing.T) {
+		_, err := evaluatePredicate(&RulePredicate{When: "identity.metadata_public.role !="}, nil, nil)
+		if err == nil {
+			t.Fatalf("expected an error for a malformed expression")
+		}
+	})
+}
+
+func TestParseImmutableRulesWithPredicate(t *testing.T) {
+	schema := []byte(`{
+		"type": "object",
+		"properties": {
+			"traits": {
+				"type": "object",
+				"properties": {
+					"email": {
+						"type": "string",
+						"zolfa.dev/kratos-readonly": {"when": "identity.metadata_public.role != 'admin'"}
+					}
+				}
+			}
+		}
+	}`)
+
+	rules, err := parseImmutableRules(schema)
+	if err != nil {
+		t.Fatalf("parseImmutableRules() error = %v", err)
+	}
+	if len(rules) != 1 {
+		t.Fatalf("expected 1 rule, got %d", len(rules))
+	}
+	if rules[0].Predicate == nil || rules[0].Predicate.When != "identity.metadata_public.role != 'admin'" {
+		t.Errorf("expected rule predicate to carry the when expression, got %+v", rules[0].Predicate)
+	}
+
+	old := map[string]interface{}{"email": "a@example.com"}
+	newT := map[string]interface{}{"email": "b@example.com"}
+
+	admin := &Identity{MetadataPublic: map[string]interface{}{"role": "admin"}}
+	messages := mustEvaluate(t, rules, old, newT, admin, nil)
+	if len(messages) != 0 {
+		t.Errorf("expected admins to be allowed to change email, got %v", messages)
+	}
+
+	user := &Identity{MetadataPublic: map[string]interface{}{"role": "user"}}
+	messages = mustEvaluate(t, rules, old, newT, user, nil)
+	assertSingleViolation(t, messages, "#/traits/email")
+	if messages[0].Messages[0].Reason == "" {
+		t.Errorf("expected the conditional violation to explain which rule blocked it")
+	}
+}
+
+func TestConditionalRuleNeverBlocksUnrelatedTraitChanges(t *testing.T) {
+	// A conditional rule on "email" needs identity to evaluate; a request
+	// that omits identity (legal per WebhookRequest's "identity,omitempty")
+	// and only changes the unrelated, unconditionally-mutable "username"
+	// trait must still succeed rather than fail the predicate evaluation.
+	rules := []ImmutableRule{
+		{
+			segments:  []pointerSegment{{key: "email"}},
+			Mode:      ImmutableAlways,
+			Predicate: &RulePredicate{When: "identity.metadata_public.role != 'admin'"},
+		},
+	}
+
+	old := map[string]interface{}{"email": "a@example.com", "username": "alice"}
+	newT := map[string]interface{}{"email": "a@example.com", "username": "bob"}
+
+	messages := mustEvaluate(t, rules, old, newT, nil, nil)
+	if len(messages) != 0 {
+		t.Fatalf("expected no violations when only the unconditional trait changed, got %v", messages)
+	}
+}
+
+func TestConditionalRuleEvaluationErrorScopedToItsOwnViolation(t *testing.T) {
+	rules := []ImmutableRule{
+		{
+			segments:  []pointerSegment{{key: "email"}},
+			Mode:      ImmutableAlways,
+			Predicate: &RulePredicate{When: "identity.metadata_public.role != 'admin'"},
+		},
+	}
+
+	old := map[string]interface{}{"email": "a@example.com", "username": "alice"}
+	newT := map[string]interface{}{"email": "b@example.com", "username": "bob"}
+
+	// No identity: the predicate can't be evaluated for the trait that
+	// actually changed, so it must surface as that trait's own violation
+	// instead of a request-wide error.
+	messages := mustEvaluate(t, rules, old, newT, nil, nil)
+	assertSingleViolation(t, messages, "#/traits/email")
+	if messages[0].Messages[0].Reason == "" {
+		t.Errorf("expected the evaluation failure to be explained in the violation's reason")
+	}
+}
+
+func TestRulePredicateReason(t *testing.T) {
+	if reason := (*RulePredicate)(nil).Reason(); reason != "" {
+		t.Errorf("expected an unconditional rule to have no reason, got %q", reason)
+	}
+
+	pred := &RulePredicate{When: "identity.metadata_public.role != 'admin'"}
+	if reason := pred.Reason(); reason == "" {
+		t.Errorf("expected a when-predicate to produce a non-empty reason")
+	}
+
+	pred = &RulePredicate{UnlessFlow: "recovery"}
+	if reason := pred.Reason(); reason == "" {
+		t.Errorf("expected an unless_flow-predicate to produce a non-empty reason")
+	}
+}
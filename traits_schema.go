@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// ImmutabilityMode describes why a schema node is treated as immutable.
+type ImmutabilityMode int
+
+const (
+	// ImmutableAlways forbids any change to the value, matching the
+	// standard JSON Schema `readOnly: true` keyword and the module's
+	// original `zolfa.dev/kratos-readonly` extension.
+	ImmutableAlways ImmutabilityMode = iota
+	// ImmutableAfterSet forbids changes only once the value has been
+	// set to something non-empty, via `x-kratos-immutable-after-set`.
+	ImmutableAfterSet
+)
+
+// pointerSegment is one step of a JSON Pointer template describing where
+// in the traits document an ImmutableRule applies. isArrayItem segments
+// expand to every index present in the old or new value at evaluation
+// time, since the schema doesn't know concrete array lengths.
+type pointerSegment struct {
+	key         string
+	isArrayItem bool
+}
+
+// ImmutableRule describes one subtree of the traits document that must
+// not change, as derived from the identity schema. A nil Predicate means
+// the rule always applies; otherwise it only applies for requests where
+// Predicate evaluates to true (see RulePredicate).
+type ImmutableRule struct {
+	segments  []pointerSegment
+	Mode      ImmutabilityMode
+	Predicate *RulePredicate
+}
+
+// parseImmutableRules validates rawSchema as JSON Schema and walks
+// `properties.traits` to collect the set of ImmutableRules it declares,
+// honoring the standard `readOnly` keyword, the `zolfa.dev/kratos-readonly`
+// extension, and `x-kratos-immutable-after-set`. Nested objects and
+// arrays are followed so rules can target deeply nested traits.
+func parseImmutableRules(rawSchema []byte) ([]ImmutableRule, error) {
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource("schema.json", strings.NewReader(string(rawSchema))); err != nil {
+		return nil, fmt.Errorf("invalid identity schema: %v", err)
+	}
+	if _, err := compiler.Compile("schema.json"); err != nil {
+		return nil, fmt.Errorf("invalid identity schema: %v", err)
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(rawSchema, &doc); err != nil {
+		return nil, fmt.Errorf("failed to decode schema: %v", err)
+	}
+
+	properties, _ := doc["properties"].(map[string]interface{})
+	traits, _ := properties["traits"].(map[string]interface{})
+	traitProperties, _ := traits["properties"].(map[string]interface{})
+
+	var rules []ImmutableRule
+	for trait, node := range traitProperties {
+		nodeSchema, _ := node.(map[string]interface{})
+		walkSchemaNode(nodeSchema, []pointerSegment{{key: trait}}, &rules)
+	}
+	return rules, nil
+}
+
+// walkSchemaNode recurses into a JSON Schema node, recording an
+// ImmutableRule at the segment path built so far whenever the node is
+// marked immutable, and otherwise descending into object properties or
+// array items.
+func walkSchemaNode(node map[string]interface{}, segments []pointerSegment, rules *[]ImmutableRule) {
+	if node == nil {
+		return
+	}
+
+	if mode, predicate, ok := immutabilityMode(node); ok {
+		*rules = append(*rules, ImmutableRule{
+			segments:  append([]pointerSegment{}, segments...),
+			Mode:      mode,
+			Predicate: predicate,
+		})
+		return
+	}
+
+	if props, ok := node["properties"].(map[string]interface{}); ok {
+		for name, child := range props {
+			childSchema, _ := child.(map[string]interface{})
+			walkSchemaNode(childSchema, append(append([]pointerSegment{}, segments...), pointerSegment{key: name}), rules)
+		}
+	}
+
+	if items, ok := node["items"].(map[string]interface{}); ok {
+		walkSchemaNode(items, append(append([]pointerSegment{}, segments...), pointerSegment{isArrayItem: true}), rules)
+	}
+}
+
+// immutabilityMode reports whether a schema node is itself marked
+// immutable, and if so under which mode and with what predicate (nil if
+// the rule is unconditional).
+func immutabilityMode(node map[string]interface{}) (ImmutabilityMode, *RulePredicate, bool) {
+	if readOnly, ok := node["readOnly"].(bool); ok && readOnly {
+		return ImmutableAlways, nil, true
+	}
+	if legacy, ok := node["zolfa.dev/kratos-readonly"]; ok {
+		switch v := legacy.(type) {
+		case bool:
+			if v {
+				return ImmutableAlways, nil, true
+			}
+		case map[string]interface{}:
+			return ImmutableAlways, parseRulePredicate(v), true
+		}
+	}
+	if afterSet, ok := node["x-kratos-immutable-after-set"].(bool); ok && afterSet {
+		return ImmutableAfterSet, nil, true
+	}
+	return 0, nil, false
+}
+
+// traitChange is one offending old/new value pair found while walking an
+// ImmutableRule against concrete trait data, addressed by its concrete
+// JSON Pointer (e.g. "/traits/address/country", no leading "#"). It's the
+// shared building block behind violation messages (evaluateImmutableRules),
+// diffs (validateTraitsHandler), and revert patches (mutateTraitsHandler).
+type traitChange struct {
+	pointer string
+	mode    ImmutabilityMode
+	oldVal  interface{}
+	newVal  interface{}
+	hadOld  bool
+	// reason explains which rule blocked the change, e.g. the predicate
+	// condition that matched. Empty for an unconditional rule (see
+	// RulePredicate.Reason).
+	reason string
+}
+
+// collectForbiddenChanges compares oldTraits/newTraits against every rule
+// and returns one traitChange per offending value. A rule's Predicate is
+// only evaluated once the rule's own trait is found to have actually
+// changed, so a conditional rule anywhere in the schema can never turn an
+// unrelated, unconditionally-mutable trait change into an error (e.g. a
+// request missing `identity`, which predicates like
+// `identity.metadata_public.role != 'admin'` need, must still succeed as
+// long as it doesn't touch that rule's trait). If a predicate does fail
+// to evaluate for a rule whose trait changed, that failure is reported as
+// the rule's own violation instead of aborting the whole batch.
+func collectForbiddenChanges(rules []ImmutableRule, oldTraits, newTraits map[string]interface{}, identity *Identity, flow *Flow) []traitChange {
+	var changes []traitChange
+	for _, rule := range rules {
+		var ruleChanges []traitChange
+		collectRuleChanges(rule.segments, 0, oldTraits, newTraits, "/traits", rule.Mode, &ruleChanges)
+		if len(ruleChanges) == 0 {
+			continue
+		}
+
+		active, err := evaluatePredicate(rule.Predicate, identity, flow)
+		reason := rule.Predicate.Reason()
+		if err != nil {
+			reason = fmt.Sprintf("could not evaluate rule condition: %v", err)
+		} else if !active {
+			continue
+		}
+
+		for i := range ruleChanges {
+			ruleChanges[i].reason = reason
+		}
+		changes = append(changes, ruleChanges...)
+	}
+	return changes
+}
+
+// evaluateImmutableRules compares oldTraits/newTraits against every rule
+// that applies to this request (see RulePredicate) and returns a
+// Kratos-compatible violation message per offending value, addressed by
+// its concrete JSON Pointer (e.g. "#/traits/address/country").
+func evaluateImmutableRules(rules []ImmutableRule, oldTraits, newTraits map[string]interface{}, identity *Identity, flow *Flow) ([]WebhookResponseTopMessage, error) {
+	changes := collectForbiddenChanges(rules, oldTraits, newTraits, identity, flow)
+	return violationMessages(changes), nil
+}
+
+// violationMessages renders changes as Kratos-compatible violation
+// messages, one per change, in the same order they were collected.
+func violationMessages(changes []traitChange) []WebhookResponseTopMessage {
+	messages := make([]WebhookResponseTopMessage, 0, len(changes))
+	for _, c := range changes {
+		messages = append(messages, WebhookResponseTopMessage{
+			InstancePtr: "#" + c.pointer,
+			Messages: []WebhookResponseNestedMessage{
+				{
+					ID:     violationMessageID(c.mode),
+					Type:   "conflict",
+					Reason: c.reason,
+				},
+			},
+		})
+	}
+	return messages
+}
+
+// collectRuleChanges walks old/new values in lockstep with a rule's
+// pointer segments, expanding array-item segments across every index
+// present in either side, and appends a traitChange once it reaches a
+// leaf whose value changed in a way the rule's mode forbids. The
+// returned changes' reason field is left empty; the caller fills it in
+// once it knows whether (and why) the rule's predicate applied.
+func collectRuleChanges(segments []pointerSegment, idx int, oldVal, newVal interface{}, pointer string, mode ImmutabilityMode, out *[]traitChange) {
+	if idx == len(segments) {
+		if isForbiddenChange(mode, oldVal, newVal) {
+			*out = append(*out, traitChange{
+				pointer: pointer,
+				mode:    mode,
+				oldVal:  oldVal,
+				newVal:  newVal,
+				hadOld:  oldVal != nil,
+			})
+		}
+		return
+	}
+
+	seg := segments[idx]
+	if seg.isArrayItem {
+		oldSlice, _ := oldVal.([]interface{})
+		newSlice, _ := newVal.([]interface{})
+		n := len(oldSlice)
+		if len(newSlice) > n {
+			n = len(newSlice)
+		}
+		for i := 0; i < n; i++ {
+			var ov, nv interface{}
+			if i < len(oldSlice) {
+				ov = oldSlice[i]
+			}
+			if i < len(newSlice) {
+				nv = newSlice[i]
+			}
+			collectRuleChanges(segments, idx+1, ov, nv, pointer+"/"+strconv.Itoa(i), mode, out)
+		}
+		return
+	}
+
+	oldMap, _ := oldVal.(map[string]interface{})
+	newMap, _ := newVal.(map[string]interface{})
+	var ov, nv interface{}
+	if oldMap != nil {
+		ov = oldMap[seg.key]
+	}
+	if newMap != nil {
+		nv = newMap[seg.key]
+	}
+	collectRuleChanges(segments, idx+1, ov, nv, pointer+"/"+escapePointerSegment(seg.key), mode, out)
+}
+
+// isForbiddenChange reports whether changing oldVal to newVal violates
+// mode. ImmutableAlways forbids any change once a new value is present;
+// ImmutableAfterSet only kicks in once the old value was already set.
+func isForbiddenChange(mode ImmutabilityMode, oldVal, newVal interface{}) bool {
+	if newVal == nil || reflect.DeepEqual(oldVal, newVal) {
+		return false
+	}
+	switch mode {
+	case ImmutableAfterSet:
+		return !isEmptyValue(oldVal)
+	default:
+		return true
+	}
+}
+
+// isEmptyValue reports whether v is the zero value Kratos would send for
+// an unset trait: nil, an empty string, or an empty collection.
+func isEmptyValue(v interface{}) bool {
+	switch val := v.(type) {
+	case nil:
+		return true
+	case string:
+		return val == ""
+	case map[string]interface{}:
+		return len(val) == 0
+	case []interface{}:
+		return len(val) == 0
+	default:
+		return false
+	}
+}
+
+// violationMessageID returns the stable Kratos message ID for mode (see
+// the MessageID* constants in violation_reporter.go). The message text
+// itself is resolved later, at response time, by ViolationReporter so it
+// can be localized per request.
+func violationMessageID(mode ImmutabilityMode) int {
+	if mode == ImmutableAfterSet {
+		return MessageIDReadOnlyAfterSet
+	}
+	return MessageIDReadOnly
+}
+
+// escapePointerSegment escapes a single JSON Pointer reference token per
+// RFC 6901 ("~" -> "~0", "/" -> "~1").
+func escapePointerSegment(key string) string {
+	key = strings.ReplaceAll(key, "~", "~0")
+	key = strings.ReplaceAll(key, "/", "~1")
+	return key
+}
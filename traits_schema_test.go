@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseImmutableRulesAndEvaluate(t *testing.T) {
+	schema := []byte(`{
+		"type": "object",
+		"properties": {
+			"traits": {
+				"type": "object",
+				"properties": {
+					"email": { "type": "string", "readOnly": true },
+					"username": { "type": "string" },
+					"role": { "type": "string", "zolfa.dev/kratos-readonly": true },
+					"nickname": { "type": "string", "x-kratos-immutable-after-set": true },
+					"address": {
+						"type": "object",
+						"properties": {
+							"country": { "type": "string", "readOnly": true }
+						}
+					},
+					"phones": {
+						"type": "array",
+						"items": {
+							"type": "object",
+							"properties": {
+								"number": { "type": "string", "readOnly": true }
+							}
+						}
+					}
+				}
+			}
+		}
+	}`)
+
+	rules, err := parseImmutableRules(schema)
+	if err != nil {
+		t.Fatalf("parseImmutableRules() error = %v", err)
+	}
+	if len(rules) != 5 {
+		t.Fatalf("expected 5 immutability rules, got %d", len(rules))
+	}
+
+	t.Run("readOnly keyword blocks a top-level trait change", func(t *testing.T) {
+		old := map[string]interface{}{"email": "a@example.com"}
+		newT := map[string]interface{}{"email": "b@example.com"}
+		messages := mustEvaluate(t, rules, old, newT, nil, nil)
+		assertSingleViolation(t, messages, "#/traits/email")
+	})
+
+	t.Run("mutable trait is left alone", func(t *testing.T) {
+		old := map[string]interface{}{"username": "alice"}
+		newT := map[string]interface{}{"username": "bob"}
+		messages := mustEvaluate(t, rules, old, newT, nil, nil)
+		if len(messages) != 0 {
+			t.Errorf("expected no violations, got %v", messages)
+		}
+	})
+
+	t.Run("legacy zolfa.dev/kratos-readonly extension still blocks changes", func(t *testing.T) {
+		old := map[string]interface{}{"role": "user"}
+		newT := map[string]interface{}{"role": "admin"}
+		messages := mustEvaluate(t, rules, old, newT, nil, nil)
+		assertSingleViolation(t, messages, "#/traits/role")
+	})
+
+	t.Run("x-kratos-immutable-after-set allows the first set but not later changes", func(t *testing.T) {
+		old := map[string]interface{}{}
+		newT := map[string]interface{}{"nickname": "ace"}
+		if messages := mustEvaluate(t, rules, old, newT, nil, nil); len(messages) != 0 {
+			t.Errorf("expected first set to be allowed, got %v", messages)
+		}
+
+		old = map[string]interface{}{"nickname": "ace"}
+		newT = map[string]interface{}{"nickname": "bee"}
+		messages := mustEvaluate(t, rules, old, newT, nil, nil)
+		assertSingleViolation(t, messages, "#/traits/nickname")
+	})
+
+	t.Run("nested object traits report a pointer into the nested path", func(t *testing.T) {
+		old := map[string]interface{}{
+			"address": map[string]interface{}{"country": "IT"},
+		}
+		newT := map[string]interface{}{
+			"address": map[string]interface{}{"country": "FR"},
+		}
+		messages := mustEvaluate(t, rules, old, newT, nil, nil)
+		assertSingleViolation(t, messages, "#/traits/address/country")
+	})
+
+	t.Run("array items report a pointer per offending index", func(t *testing.T) {
+		old := map[string]interface{}{
+			"phones": []interface{}{
+				map[string]interface{}{"number": "111"},
+				map[string]interface{}{"number": "222"},
+			},
+		}
+		newT := map[string]interface{}{
+			"phones": []interface{}{
+				map[string]interface{}{"number": "111"},
+				map[string]interface{}{"number": "999"},
+			},
+		}
+		messages := mustEvaluate(t, rules, old, newT, nil, nil)
+		assertSingleViolation(t, messages, "#/traits/phones/1/number")
+	})
+}
+
+func mustEvaluate(t *testing.T, rules []ImmutableRule, oldTraits, newTraits map[string]interface{}, identity *Identity, flow *Flow) []WebhookResponseTopMessage {
+	t.Helper()
+	messages, err := evaluateImmutableRules(rules, oldTraits, newTraits, identity, flow)
+	if err != nil {
+		t.Fatalf("evaluateImmutableRules() error = %v", err)
+	}
+	return messages
+}
+
+func assertSingleViolation(t *testing.T, messages []WebhookResponseTopMessage, wantPointer string) {
+	t.Helper()
+	if len(messages) != 1 {
+		t.Fatalf("expected exactly 1 violation, got %d: %v", len(messages), messages)
+	}
+	if messages[0].InstancePtr != wantPointer {
+		t.Errorf("expected instance pointer %q, got %q", wantPointer, messages[0].InstancePtr)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// Message IDs are stable, numeric identifiers for each kind of violation
+// this module can report. They are part of the exported API: downstream
+// consumers should match on these rather than parsing message text, same
+// as Kratos' own UI text schema.
+const (
+	// MessageIDReadOnly is reported when an always-immutable trait (the
+	// standard readOnly keyword, the zolfa.dev/kratos-readonly
+	// extension, or a satisfied conditional rule) changed.
+	MessageIDReadOnly = 4000000
+	// MessageIDReadOnlyAfterSet is reported when a trait marked
+	// x-kratos-immutable-after-set changed after already being set.
+	MessageIDReadOnlyAfterSet = 4000001
+)
+
+// messageKeys maps each message ID to the catalog key used to look up
+// its localized text.
+var messageKeys = map[int]string{
+	MessageIDReadOnly:         "read-only",
+	MessageIDReadOnlyAfterSet: "read-only-after-set",
+}
+
+func init() {
+	message.SetString(language.English, "read-only", "Element is read-only.")
+	message.SetString(language.English, "read-only-after-set", "Element is read-only once set.")
+	message.SetString(language.Italian, "read-only", "L'elemento è di sola lettura.")
+	message.SetString(language.Italian, "read-only-after-set", "L'elemento è di sola lettura una volta impostato.")
+}
+
+// supportedLanguages is used to match the caller's Accept-Language
+// header to one of the module's bundled translations.
+var supportedLanguages = language.NewMatcher([]language.Tag{
+	language.English,
+	language.Italian,
+})
+
+// MessageProvider renders the localized text for a violation message ID
+// in the given language, returning ok=false to fall through to the next
+// provider (or the module's bundled catalog).
+type MessageProvider func(id int, lang language.Tag) (text string, ok bool)
+
+// customMessageProviders are consulted, most-recently-registered first,
+// before falling back to the bundled catalog.
+var customMessageProviders []MessageProvider
+
+// RegisterMessageProvider lets downstream applications plug in their own
+// message catalog, e.g. to add a language this module doesn't ship or to
+// override the default English/Italian text. Providers registered later
+// take precedence over ones registered earlier.
+func RegisterMessageProvider(provider MessageProvider) {
+	customMessageProviders = append([]MessageProvider{provider}, customMessageProviders...)
+}
+
+// localizedText resolves the display text for a message ID and
+// requested language, preferring registered custom providers over the
+// module's bundled catalog.
+func localizedText(id int, lang language.Tag) string {
+	for _, provider := range customMessageProviders {
+		if text, ok := provider(id, lang); ok {
+			return text
+		}
+	}
+	key, ok := messageKeys[id]
+	if !ok {
+		return ""
+	}
+	return message.NewPrinter(lang).Sprintf(key)
+}
+
+// localizedViolationMessages returns a copy of violations with each
+// nested message's Text resolved for r's negotiated Accept-Language, the
+// same way ViolationReporter.Report localizes the check-readonly-traits
+// response. Other handlers (e.g. validateTraitsHandler) that build their
+// own response instead of going through ViolationReporter should still
+// route their messages through this so every endpoint reports the same
+// localized text.
+func localizedViolationMessages(r *http.Request, violations []WebhookResponseTopMessage) []WebhookResponseTopMessage {
+	lang, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	tag, _, _ := supportedLanguages.Match(lang...)
+
+	localized := make([]WebhookResponseTopMessage, len(violations))
+	for i, violation := range violations {
+		nested := make([]WebhookResponseNestedMessage, len(violation.Messages))
+		for j, m := range violation.Messages {
+			nested[j] = WebhookResponseNestedMessage{
+				ID:     m.ID,
+				Type:   m.Type,
+				Text:   localizedText(m.ID, tag),
+				Reason: m.Reason,
+			}
+		}
+		localized[i] = WebhookResponseTopMessage{InstancePtr: violation.InstancePtr, Messages: nested}
+	}
+	return localized
+}
+
+// ViolationReporter writes the Kratos-compatible webhook response for a
+// set of violations, negotiating the response language from the
+// request's Accept-Language header.
+type ViolationReporter struct{}
+
+// Report writes violations as a localized 409 Conflict, or 200 OK when
+// there are none, and always returns having written exactly one status
+// code. Callers must not write to w afterwards.
+func (ViolationReporter) Report(w http.ResponseWriter, r *http.Request, violations []WebhookResponseTopMessage) {
+	if len(violations) == 0 {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	localized := localizedViolationMessages(r, violations)
+
+	log.Printf("Update request denied")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(WebhookResponse{Messages: localized})
+}
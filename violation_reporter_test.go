@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/text/language"
+)
+
+func TestViolationReporterReport(t *testing.T) {
+	t.Run("no violations writes 200 and nothing else", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/hooks/check-readonly-traits", nil)
+
+		var reporter ViolationReporter
+		reporter.Report(rr, req, nil)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+		if rr.Body.Len() != 0 {
+			t.Errorf("expected empty body, got %q", rr.Body.String())
+		}
+	})
+
+	t.Run("violations write exactly one 409 with default English text", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/hooks/check-readonly-traits", nil)
+
+		violations := []WebhookResponseTopMessage{
+			{
+				InstancePtr: "#/traits/email",
+				Messages:    []WebhookResponseNestedMessage{{ID: MessageIDReadOnly, Type: "conflict"}},
+			},
+		}
+
+		var reporter ViolationReporter
+		reporter.Report(rr, req, violations)
+
+		if rr.Code != http.StatusConflict {
+			t.Fatalf("expected status %d, got %d", http.StatusConflict, rr.Code)
+		}
+
+		var got WebhookResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if len(got.Messages) != 1 || len(got.Messages[0].Messages) != 1 {
+			t.Fatalf("unexpected response shape: %+v", got)
+		}
+		if got.Messages[0].Messages[0].Text != "Element is read-only." {
+			t.Errorf("expected default English text, got %q", got.Messages[0].Messages[0].Text)
+		}
+	})
+
+	t.Run("Accept-Language negotiates a bundled translation", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/hooks/check-readonly-traits", nil)
+		req.Header.Set("Accept-Language", "it")
+
+		violations := []WebhookResponseTopMessage{
+			{
+				InstancePtr: "#/traits/email",
+				Messages:    []WebhookResponseNestedMessage{{ID: MessageIDReadOnly, Type: "conflict"}},
+			},
+		}
+
+		var reporter ViolationReporter
+		reporter.Report(rr, req, violations)
+
+		var got WebhookResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if got.Messages[0].Messages[0].Text != "L'elemento è di sola lettura." {
+			t.Errorf("expected Italian text, got %q", got.Messages[0].Messages[0].Text)
+		}
+	})
+
+	t.Run("registered custom provider overrides the bundled catalog", func(t *testing.T) {
+		RegisterMessageProvider(func(id int, lang language.Tag) (string, bool) {
+			if id == MessageIDReadOnly {
+				return "custom text", true
+			}
+			return "", false
+		})
+		defer func() { customMessageProviders = nil }()
+
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/hooks/check-readonly-traits", nil)
+
+		violations := []WebhookResponseTopMessage{
+			{
+				InstancePtr: "#/traits/email",
+				Messages:    []WebhookResponseNestedMessage{{ID: MessageIDReadOnly, Type: "conflict"}},
+			},
+		}
+
+		var reporter ViolationReporter
+		reporter.Report(rr, req, violations)
+
+		var got WebhookResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if got.Messages[0].Messages[0].Text != "custom text" {
+			t.Errorf("expected custom provider text, got %q", got.Messages[0].Messages[0].Text)
+		}
+	})
+}